@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var reBpftraceClose = regexp.MustCompile(`^\]:\s*(\d+)\s*$`)
+
+type bpftraceState int
+
+const (
+	bpftraceStateOutsideStack bpftraceState = iota + 1
+	bpftraceStateInStack
+)
+
+// BpftraceParser parses bpftrace histogram output: `@[stack]: count`, where
+// the stack is a series of indented "symbol+offset" lines between "@[" and
+// "]:". bpftrace aggregates its histograms over the whole run rather than
+// attaching a timestamp to each one, so frames are weighted by count like
+// dtrace's default --time-source=count.
+type BpftraceParser struct {
+	scanner    *bufio.Scanner
+	normalizer *StackNormalizer
+	state      bpftraceState
+	stack      []string // leaf-to-root, as bpftrace prints them
+}
+
+func NewBpftraceParser(r io.Reader, normalizer *StackNormalizer) *BpftraceParser {
+	return &BpftraceParser{
+		scanner:    bufio.NewScanner(r),
+		normalizer: normalizer,
+		state:      bpftraceStateOutsideStack,
+	}
+}
+
+func (p *BpftraceParser) Next() (Frame, error) {
+	for p.scanner.Scan() {
+		line := strings.TrimSpace(p.scanner.Text())
+
+		switch p.state {
+		case bpftraceStateOutsideStack:
+			if !strings.HasPrefix(line, "@[") {
+				continue
+			}
+			p.stack = p.stack[:0]
+			p.state = bpftraceStateInStack
+			if rest := strings.TrimSpace(strings.TrimPrefix(line, "@[")); rest != "" {
+				p.stack = append(p.stack, p.normalizer.Normalize(rest))
+			}
+		case bpftraceStateInStack:
+			if m := reBpftraceClose.FindStringSubmatch(line); m != nil {
+				count, err := strconv.Atoi(m[1])
+				if err != nil {
+					return Frame{}, fmt.Errorf("%q is not a valid count", m[1])
+				}
+
+				stack := make([]string, len(p.stack))
+				for i, entry := range p.stack {
+					stack[len(p.stack)-1-i] = entry // bpftrace prints leaf-to-root; Frame wants root-to-leaf
+				}
+
+				p.state = bpftraceStateOutsideStack
+				return Frame{Stack: stack, Weight: float64(count)}, nil
+			}
+			if line != "" {
+				p.stack = append(p.stack, p.normalizer.Normalize(line))
+			}
+		}
+	}
+	if err := p.scanner.Err(); err != nil {
+		return Frame{}, err
+	}
+	return Frame{}, io.EOF
+}
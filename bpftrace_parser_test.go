@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBpftraceParserHappyPath(t *testing.T) {
+	input := "@[foo+0x10\n" +
+		"bar+0x20\n" +
+		"]: 7\n" +
+		"@[baz+0x30\n" +
+		"]: 2\n"
+	p := NewBpftraceParser(strings.NewReader(input), NewStackNormalizer("none", false, true))
+
+	frame, err := p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"bar", "foo"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+	if frame.Weight != 7 {
+		t.Fatalf("unexpected weight: got %v want 7", frame.Weight)
+	}
+
+	frame, err = p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error on second frame: %v", err)
+	}
+	if want := []string{"baz"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestBpftraceParserIgnoresLinesOutsideStack(t *testing.T) {
+	input := "Attaching 1 probe...\n" +
+		"@[foo+0x10\n" +
+		"]: 1\n"
+	p := NewBpftraceParser(strings.NewReader(input), NewStackNormalizer("none", false, true))
+
+	frame, err := p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"foo"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ianlancetaylor/demangle"
+)
+
+// StackNormalizer turns a raw stack frame string, as printed by whichever
+// InputParser produced it, into the form dtrace2spall actually emits: an
+// optional demangling pass, the "+offset" suffix stripped, and C++-style
+// function arguments/template parameters collapsed.
+type StackNormalizer struct {
+	demangleMode      string // none, itanium, rust, swift, auto
+	keepOffsets       bool
+	collapseTemplates bool
+
+	// demangling recurs constantly across samples (the same handful of hot
+	// functions show up in almost every stack) and is not cheap, so cache it.
+	demangleCache map[string]string
+}
+
+func NewStackNormalizer(demangleMode string, keepOffsets, collapseTemplates bool) *StackNormalizer {
+	return &StackNormalizer{
+		demangleMode:      demangleMode,
+		keepOffsets:       keepOffsets,
+		collapseTemplates: collapseTemplates,
+		demangleCache:     make(map[string]string),
+	}
+}
+
+func (n *StackNormalizer) Normalize(entry string) string {
+	if n.demangleMode != "none" {
+		entry = n.demangle(entry)
+	}
+
+	// Split the offset off before collapse-templates runs, not just before
+	// the keep-offsets strip below: reCFunctionArgument's trailing ".*" is
+	// greedy to end-of-string, so if it ran on an entry with the offset
+	// still attached it would eat the offset too, breaking --keep-offsets
+	// whenever --collapse-templates is left at its default of true.
+	var offset string
+	if n.keepOffsets {
+		if loc := reOffset.FindStringIndex(entry); loc != nil {
+			entry, offset = entry[:loc[0]], entry[loc[0]:]
+		}
+	} else {
+		entry = reOffset.ReplaceAllString(entry, "")
+	}
+
+	if n.collapseTemplates {
+		entry = reCFunctionArgument.ReplaceAllString(entry, "$1")
+	}
+	entry += offset
+
+	if entry == "" {
+		entry = "-"
+	}
+	return entry
+}
+
+func (n *StackNormalizer) demangle(entry string) string {
+	if cached, ok := n.demangleCache[entry]; ok {
+		return cached
+	}
+
+	var result string
+	switch n.demangleMode {
+	case "itanium":
+		result = demangleItanium(entry)
+	case "rust":
+		result = demangleRust(entry)
+	case "swift":
+		result = demangleSwift(entry)
+	default: // "auto"
+		result = demangleAuto(entry)
+	}
+
+	n.demangleCache[entry] = result
+	return result
+}
+
+// reModulePrefix matches a DTrace-style "module`" prefix on a ustack()
+// frame, e.g. the "libc.so.1`" in "libc.so.1`malloc+0x20".
+var reModulePrefix = regexp.MustCompile("^.*`")
+
+// splitMangled pulls the module prefix and "+offset" suffix off of entry, so
+// callers can hand demangle.Filter just the mangled name in the middle: it
+// requires the whole input to be a valid mangled name and otherwise fails
+// closed, returning the string unchanged.
+func splitMangled(entry string) (prefix, core, suffix string) {
+	core = entry
+	if m := reModulePrefix.FindString(core); m != "" {
+		prefix, core = m, core[len(m):]
+	}
+	if loc := reOffset.FindStringIndex(core); loc != nil {
+		core, suffix = core[:loc[0]], core[loc[0]:]
+	}
+	return prefix, core, suffix
+}
+
+// demangleItanium demangles Itanium C++ mangled names (the "_Z..." ABI used
+// by GCC/Clang), acting like c++filt.
+func demangleItanium(entry string) string {
+	prefix, core, suffix := splitMangled(entry)
+	if !strings.Contains(core, "_Z") {
+		return entry
+	}
+	return prefix + demangle.Filter(core) + suffix
+}
+
+// demangleRust demangles Rust's legacy ("_ZN...17hSOMEHASHE") and v0
+// ("_R...") mangling schemes.
+func demangleRust(entry string) string {
+	prefix, core, suffix := splitMangled(entry)
+	if !strings.Contains(core, "_R") && !strings.Contains(core, "_Z") {
+		return entry
+	}
+	return prefix + demangle.Filter(core) + suffix
+}
+
+// demangleSwift is currently a pass-through: there is no maintained
+// pure-Go Swift demangler to lean on the way ianlancetaylor/demangle covers
+// Itanium and Rust. --demangle=swift is accepted so scripts don't have to
+// special-case it, but it won't change anything yet.
+func demangleSwift(entry string) string {
+	return entry
+}
+
+func demangleAuto(entry string) string {
+	prefix, core, suffix := splitMangled(entry)
+	return prefix + demangle.Filter(core) + suffix
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bvisness/spall-go"
+)
+
+type dtraceState int
+
+const (
+	dtraceStateExpectingNewFrame dtraceState = iota + 1 // waiting for fields or the first entry in a stack
+	dtraceStateInFrame                                  // waiting for the count to end the frame
+)
+
+// DTraceParser parses dtrace aggregation output: an optional line of
+// whitespace-separated --fields values, then one stack entry per line, then
+// a line containing just the aggregated sample count, with frames separated
+// by blank lines.
+type DTraceParser struct {
+	scanner    *bufio.Scanner
+	fields     []string
+	timeSource string
+	unit       spall.TimestampUnit
+	normalizer *StackNormalizer
+
+	state                    dtraceState
+	pid, tid                 uint32
+	timestamp, walltimestamp uint64
+	stackEntries             []string // leaf-to-root, as dtrace prints them
+}
+
+func NewDTraceParser(r io.Reader, fields []string, timeSource string, unit spall.TimestampUnit, normalizer *StackNormalizer) *DTraceParser {
+	return &DTraceParser{
+		scanner:    bufio.NewScanner(r),
+		fields:     fields,
+		timeSource: timeSource,
+		unit:       unit,
+		normalizer: normalizer,
+		state:      dtraceStateExpectingNewFrame,
+	}
+}
+
+func (p *DTraceParser) Next() (Frame, error) {
+	for p.scanner.Scan() {
+		line := strings.TrimSpace(p.scanner.Text())
+
+		if line == "" {
+			// Nothin'. Must be between frames.
+			p.state = dtraceStateExpectingNewFrame
+			continue
+		}
+
+		if p.state == dtraceStateExpectingNewFrame {
+			// Non-empty line starts a new frame
+
+			// Parse fields, or just start directly at the trace
+			if len(p.fields) == 0 {
+				p.stackEntries = append(p.stackEntries, p.normalizer.Normalize(line))
+			} else {
+				fieldStrs := reWhitespace.Split(line, -1)
+				if len(fieldStrs) != len(p.fields) {
+					return Frame{}, fmt.Errorf("expected %d fields but got %d; problematic line:\n%s", len(p.fields), len(fieldStrs), line)
+				}
+
+				for i, fieldStr := range fieldStrs {
+					switch p.fields[i] {
+					case "pid":
+						pidU64, err := strconv.ParseUint(fieldStr, 10, 32)
+						if err != nil {
+							return Frame{}, fmt.Errorf("%q is not a valid pid", fieldStr)
+						}
+						p.pid = uint32(pidU64)
+					case "tid":
+						tidU64, err := strconv.ParseUint(fieldStr, 10, 32)
+						if err != nil {
+							return Frame{}, fmt.Errorf("%q is not a valid tid", fieldStr)
+						}
+						p.tid = uint32(tidU64)
+					case "timestamp":
+						ns, err := strconv.ParseUint(fieldStr, 10, 64)
+						if err != nil {
+							return Frame{}, fmt.Errorf("%q is not a valid timestamp", fieldStr)
+						}
+						p.timestamp = ns
+					case "walltimestamp":
+						ns, err := strconv.ParseUint(fieldStr, 10, 64)
+						if err != nil {
+							return Frame{}, fmt.Errorf("%q is not a valid walltimestamp", fieldStr)
+						}
+						p.walltimestamp = ns
+					default:
+						// Ignore all others.
+					}
+				}
+			}
+
+			p.state = dtraceStateInFrame
+		} else if p.state == dtraceStateInFrame && reCount.MatchString(line) {
+			// End of a stack; build the Frame
+			count, err := strconv.Atoi(line)
+			if err != nil {
+				return Frame{}, fmt.Errorf("%q is not a valid sample count", line)
+			}
+
+			frame := Frame{Pid: p.pid, Tid: p.tid}
+			switch p.timeSource {
+			case "timestamp":
+				frame.Weight = nsToWhen(p.timestamp, p.unit)
+				frame.Absolute = true
+			case "walltimestamp":
+				frame.Weight = nsToWhen(p.walltimestamp, p.unit)
+				frame.Absolute = true
+			default:
+				frame.Weight = float64(count)
+			}
+
+			frame.Stack = make([]string, len(p.stackEntries))
+			for i, entry := range p.stackEntries {
+				frame.Stack[len(p.stackEntries)-1-i] = entry // dtrace prints leaf-to-root; Frame wants root-to-leaf
+			}
+
+			// Reset frame
+			p.pid, p.tid, p.timestamp, p.walltimestamp = 0, 0, 0, 0
+			p.stackEntries = p.stackEntries[:0] // reset stack in place (reuse memory)
+			p.state = dtraceStateExpectingNewFrame
+
+			return frame, nil
+		} else if p.state == dtraceStateInFrame {
+			// One entry in a stack
+			p.stackEntries = append(p.stackEntries, p.normalizer.Normalize(line))
+		} else {
+			panic("bad state!")
+		}
+	}
+	if err := p.scanner.Err(); err != nil {
+		return Frame{}, err
+	}
+	return Frame{}, io.EOF
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDTraceParserHappyPath(t *testing.T) {
+	input := "123 456\nfoo\nbar\n5\n\n123 456\nbaz\n3\n"
+	p := NewDTraceParser(strings.NewReader(input), []string{"pid", "tid"}, "count", 1, NewStackNormalizer("none", false, true))
+
+	frame, err := p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame.Pid != 123 || frame.Tid != 456 {
+		t.Fatalf("unexpected pid/tid: %+v", frame)
+	}
+	if want := []string{"bar", "foo"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+	if frame.Weight != 5 || frame.Absolute {
+		t.Fatalf("unexpected weight/absolute: %+v", frame)
+	}
+
+	frame, err = p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error on second frame: %v", err)
+	}
+	if want := []string{"baz"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDTraceParserTimestampSource(t *testing.T) {
+	input := "1000000000\nfoo\n5\n"
+	p := NewDTraceParser(strings.NewReader(input), []string{"timestamp"}, "timestamp", 1000, NewStackNormalizer("none", false, true))
+
+	frame, err := p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !frame.Absolute {
+		t.Fatalf("expected Absolute=true for --time-source=timestamp")
+	}
+	if frame.Weight != 1000 { // 1e9 ns -> 1e6 us -> /1000 unit = 1000
+		t.Fatalf("unexpected weight: got %v want 1000", frame.Weight)
+	}
+}
+
+func TestDTraceParserBadFieldCount(t *testing.T) {
+	input := "123\nfoo\n5\n"
+	p := NewDTraceParser(strings.NewReader(input), []string{"pid", "tid"}, "count", 1, NewStackNormalizer("none", false, true))
+
+	if _, err := p.Next(); err == nil {
+		t.Fatalf("expected an error for a field-count mismatch")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/bvisness/spall-go"
+)
+
+// FirefoxProfileWriter buffers per-thread stacks in memory and emits them as
+// a Firefox Profiler "processed profile" in Footer, reconstructing a samples
+// table from the Begin/End events since that format is sample-based rather
+// than evented.
+//
+// https://github.com/firefox-devtools/profiler/blob/main/docs-developer/processed-profile-format.md
+type FirefoxProfileWriter struct {
+	w    io.Writer
+	unit spall.TimestampUnit
+
+	order   []PidTid
+	threads map[PidTid]*firefoxThread
+}
+
+// firefoxThread accumulates one thread's stringTable, frameTable, stackTable
+// and samples as parallel columns, deduping frames and stacks as they recur.
+type firefoxThread struct {
+	stringTable   []string
+	stringIndices map[string]int
+
+	frameFunc []int // frameTable.func: frame index -> stringTable index
+	frameOf   map[string]int
+
+	stackFrame  []int // stackTable.frame: stack index -> frame index
+	stackPrefix []int // stackTable.prefix: stack index -> parent stack index, or -1 for a root frame
+	stackChild  map[[2]int]int // (prefix, frame) -> stack index
+
+	openStack []int // currently-open stack indices, one per Begin with no matching End yet
+
+	sampleStack []int     // samples.stack: one entry per sample, or -1 if the stack was empty
+	sampleTime  []float64 // samples.time, in milliseconds
+}
+
+func newFirefoxThread() *firefoxThread {
+	return &firefoxThread{
+		stringIndices: make(map[string]int),
+		frameOf:       make(map[string]int),
+		stackChild:    make(map[[2]int]int),
+	}
+}
+
+func (t *firefoxThread) internString(s string) int {
+	if i, ok := t.stringIndices[s]; ok {
+		return i
+	}
+	i := len(t.stringTable)
+	t.stringTable = append(t.stringTable, s)
+	t.stringIndices[s] = i
+	return i
+}
+
+func (t *firefoxThread) frameFor(name string) int {
+	if i, ok := t.frameOf[name]; ok {
+		return i
+	}
+	i := len(t.frameFunc)
+	t.frameFunc = append(t.frameFunc, t.internString(name))
+	t.frameOf[name] = i
+	return i
+}
+
+func (t *firefoxThread) push(name string) {
+	frame := t.frameFor(name)
+	prefix := -1
+	if n := len(t.openStack); n > 0 {
+		prefix = t.openStack[n-1]
+	}
+
+	key := [2]int{prefix, frame}
+	stackIdx, ok := t.stackChild[key]
+	if !ok {
+		stackIdx = len(t.stackFrame)
+		t.stackFrame = append(t.stackFrame, frame)
+		t.stackPrefix = append(t.stackPrefix, prefix)
+		t.stackChild[key] = stackIdx
+	}
+	t.openStack = append(t.openStack, stackIdx)
+}
+
+func (t *firefoxThread) pop() {
+	if len(t.openStack) == 0 {
+		return
+	}
+	t.openStack = t.openStack[:len(t.openStack)-1]
+}
+
+func (t *firefoxThread) sample(when float64, unit spall.TimestampUnit) {
+	stackIdx := -1
+	if n := len(t.openStack); n > 0 {
+		stackIdx = t.openStack[n-1]
+	}
+	t.sampleStack = append(t.sampleStack, stackIdx)
+	t.sampleTime = append(t.sampleTime, when*float64(unit)/1000) // µs -> ms
+}
+
+func NewFirefoxProfileWriter(w io.Writer, unit spall.TimestampUnit) ProfileWriter {
+	return &FirefoxProfileWriter{
+		w:       w,
+		unit:    unit,
+		threads: make(map[PidTid]*firefoxThread),
+	}
+}
+
+func (w *FirefoxProfileWriter) Header() {}
+func (w *FirefoxProfileWriter) Flush()  {}
+
+func (w *FirefoxProfileWriter) thread(tid, pid uint32) *firefoxThread {
+	ptk := PidTid{Pid: pid, Tid: tid}
+	t, ok := w.threads[ptk]
+	if !ok {
+		t = newFirefoxThread()
+		w.threads[ptk] = t
+		w.order = append(w.order, ptk)
+	}
+	return t
+}
+
+func (w *FirefoxProfileWriter) Begin(name string, tid, pid uint32, when float64) {
+	t := w.thread(tid, pid)
+	t.push(name)
+	t.sample(when, w.unit)
+}
+
+func (w *FirefoxProfileWriter) End(tid, pid uint32, when float64) {
+	t := w.thread(tid, pid)
+	t.pop()
+	t.sample(when, w.unit)
+}
+
+func (w *FirefoxProfileWriter) Footer() {
+	type frameTable struct {
+		Func []int `json:"func"`
+	}
+	type stackTable struct {
+		Frame  []int `json:"frame"`
+		Prefix []int `json:"prefix"`
+	}
+	type samplesTable struct {
+		Stack []int     `json:"stack"`
+		Time  []float64 `json:"time"`
+	}
+	type thread struct {
+		Name        string       `json:"name"`
+		ProcessType string       `json:"processType"`
+		Pid         uint32       `json:"pid"`
+		Tid         uint32       `json:"tid"`
+		StringTable []string     `json:"stringTable"`
+		FrameTable  frameTable   `json:"frameTable"`
+		StackTable  stackTable   `json:"stackTable"`
+		Samples     samplesTable `json:"samples"`
+	}
+	type meta struct {
+		Product   string  `json:"product"`
+		Interval  float64 `json:"interval"`
+		Version   int     `json:"version"`
+		StartTime float64 `json:"startTime"`
+	}
+	type profile struct {
+		Meta    meta     `json:"meta"`
+		Threads []thread `json:"threads"`
+	}
+
+	// sampleTime carries whatever absolute "when" the writer was given (e.g.
+	// real ns-scale timestamps from --time-source=timestamp/walltimestamp,
+	// or perf's epoch-scale clock), converted to ms. Rebase to the earliest
+	// sample across all threads so the profile starts near t=0 instead of
+	// compressing the real activity into a sliver of an epoch-scale range;
+	// meta.startTime anchors the profile at that rebase point.
+	var min float64
+	haveMin := false
+	for _, ptk := range w.order {
+		for _, t := range w.threads[ptk].sampleTime {
+			if !haveMin || t < min {
+				min, haveMin = t, true
+			}
+		}
+	}
+
+	out := profile{
+		Meta: meta{
+			Product:   "dtrace2spall",
+			Interval:  1,
+			Version:   24,
+			StartTime: min,
+		},
+	}
+	for _, ptk := range w.order {
+		t := w.threads[ptk]
+		times := make([]float64, len(t.sampleTime))
+		for i, at := range t.sampleTime {
+			times[i] = at - min
+		}
+		out.Threads = append(out.Threads, thread{
+			Name:        fmt.Sprintf("pid %d tid %d", ptk.Pid, ptk.Tid),
+			ProcessType: "default",
+			Pid:         ptk.Pid,
+			Tid:         ptk.Tid,
+			StringTable: t.stringTable,
+			FrameTable:  frameTable{Func: t.frameFunc},
+			StackTable:  stackTable{Frame: t.stackFrame, Prefix: t.stackPrefix},
+			Samples:     samplesTable{Stack: t.sampleStack, Time: times},
+		})
+	}
+
+	data, _ := json.Marshal(out)
+	w.w.Write(data)
+}
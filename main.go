@@ -1,130 +1,48 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"regexp"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/bvisness/spall-go"
 	"github.com/spf13/cobra"
 )
 
-var reWhitespace = regexp.MustCompile(`\s+`)
-var reCount = regexp.MustCompile(`^\d+$`)
-var reOffset = regexp.MustCompile(`\+[^+]*$`)
-var reCFunctionArgument = regexp.MustCompile(`(::.*)[(<].*`)
-
-type State int
-
-const (
-	StateExpectingNewFrame State = iota + 1 // waiting for fields or the first entry in a stack
-	StateInFrame                            // waiting for the count to end the frame
-)
-
-type ProfileWriter interface {
-	Header()
-	Begin(name string, tid, pid uint32, when float64)
-	End(tid, pid uint32, when float64)
-	Footer()
+// followReader wraps a Reader and, when following, retries reads that hit
+// io.EOF after a short sleep instead of propagating it, so a bufio.Scanner
+// built on top of it keeps reading as more data arrives instead of stopping
+// at the first transient EOF. This is the same trick `tail -f`/journald use
+// to follow a live-growing input.
+type followReader struct {
+	r        io.Reader
+	interval time.Duration
 }
 
-type SpallWriter struct {
-	spall.Eventer
-}
-
-func NewSpallWriter(w io.Writer, unit spall.TimestampUnit) (ProfileWriter, func()) {
-	p := spall.NewProfile(w, unit)
-	e := p.NewEventer()
-
-	return &SpallWriter{e}, func() {
-		e.Close()
-		p.Close()
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		time.Sleep(f.interval)
 	}
 }
 
-func (w *SpallWriter) Header() {}
-func (w *SpallWriter) Footer() {}
-
-func (w *SpallWriter) Begin(name string, tid, pid uint32, when float64) {
-	w.Eventer.BeginTidPid(name, tid, pid, when)
-}
-
-func (w *SpallWriter) End(tid, pid uint32, when float64) {
-	w.Eventer.EndTidPid(tid, pid, when)
-}
-
-type JSONWriter struct {
-	w        io.Writer
-	unit     spall.TimestampUnit
-	didEvent bool
-}
-
-func NewJSONWriter(w io.Writer, unit spall.TimestampUnit) ProfileWriter {
-	return &JSONWriter{
-		w:    w,
-		unit: unit,
+func containsField(fields []string, name string) bool {
+	for _, field := range fields {
+		if field == name {
+			return true
+		}
 	}
-}
-
-func (w *JSONWriter) Header() {
-	w.w.Write([]byte("[\n"))
-}
-
-func (w *JSONWriter) Begin(name string, tid, pid uint32, when float64) {
-	type BeginEvent struct {
-		Name      string `json:"name"`
-		Cat       string `json:"cat"`
-		Type      string `json:"ph"`
-		Timestamp int64  `json:"ts"`
-		Pid       uint32 `json:"pid"`
-		Tid       uint32 `json:"tid"`
-	}
-
-	if w.didEvent {
-		w.w.Write([]byte(",\n"))
-	}
-	event, _ := json.Marshal(BeginEvent{
-		Name:      name,
-		Cat:       "dtrace",
-		Type:      "B",
-		Timestamp: int64(when * float64(w.unit)),
-		Pid:       pid,
-		Tid:       tid,
-	})
-	w.w.Write(event)
-
-	w.didEvent = true
-}
-
-func (w *JSONWriter) End(tid, pid uint32, when float64) {
-	type EndEvent struct {
-		Type      string `json:"ph"`
-		Timestamp int64  `json:"ts"`
-		Pid       uint32 `json:"pid"`
-		Tid       uint32 `json:"tid"`
-	}
-
-	if w.didEvent {
-		w.w.Write([]byte(",\n"))
-	}
-	event, _ := json.Marshal(EndEvent{
-		Type:      "E",
-		Timestamp: int64(when * float64(w.unit)),
-		Pid:       pid,
-		Tid:       tid,
-	})
-	w.w.Write(event)
-
-	w.didEvent = true
-}
-
-func (w *JSONWriter) Footer() {
-	w.w.Write([]byte("\n]\n"))
+	return false
 }
 
 func main() {
@@ -151,145 +69,201 @@ func main() {
 
 				freq, _ := cmd.PersistentFlags().GetInt("freq")
 				fields, _ := cmd.PersistentFlags().GetStringSlice("fields")
-				json, _ := cmd.PersistentFlags().GetBool("json")
+				format, _ := cmd.PersistentFlags().GetString("format")
+				input, _ := cmd.PersistentFlags().GetString("input")
+				follow, _ := cmd.PersistentFlags().GetBool("follow")
+				flushMs, _ := cmd.PersistentFlags().GetInt("flush-interval")
+				timeSource, _ := cmd.PersistentFlags().GetString("time-source")
+				demangleMode, _ := cmd.PersistentFlags().GetString("demangle")
+				keepOffsets, _ := cmd.PersistentFlags().GetBool("keep-offsets")
+				collapseTemplates, _ := cmd.PersistentFlags().GetBool("collapse-templates")
+
+				switch demangleMode {
+				case "none", "itanium", "rust", "swift", "auto":
+				default:
+					fmt.Fprintf(os.Stderr, "ERROR: unrecognized --demangle %q (expected one of none, itanium, rust, swift, auto)\n", demangleMode)
+					os.Exit(1)
+				}
+
+				switch timeSource {
+				case "count":
+				case "timestamp":
+					if !containsField(fields, "timestamp") {
+						fmt.Fprintln(os.Stderr, "ERROR: --time-source=timestamp requires \"timestamp\" to be present in --fields")
+						os.Exit(1)
+					}
+				case "walltimestamp":
+					if !containsField(fields, "walltimestamp") {
+						fmt.Fprintln(os.Stderr, "ERROR: --time-source=walltimestamp requires \"walltimestamp\" to be present in --fields")
+						os.Exit(1)
+					}
+				default:
+					fmt.Fprintf(os.Stderr, "ERROR: unrecognized --time-source %q (expected one of count, timestamp, walltimestamp)\n", timeSource)
+					os.Exit(1)
+				}
 
 				µsPerSample := 1_000_000 / spall.TimestampUnit(freq) // (µs/s) / (samples/s) = µs/sample
 
+				// done performs whatever teardown the chosen writer needs to
+				// guarantee its buffered output actually reaches f; it must be
+				// called on both the normal exit path and the signal handler
+				// below, since for --format=spall it is what flushes the
+				// eventer's C-side buffer (Footer is a no-op for spall).
+				done := func() {}
+
 				var w ProfileWriter
-				if json {
-					w = NewJSONWriter(f, µsPerSample)
-				} else {
-					var done func()
+				switch format {
+				case "spall":
 					w, done = NewSpallWriter(f, µsPerSample)
 					defer done()
+				case "json":
+					w = NewJSONWriter(f, µsPerSample)
+				case "speedscope":
+					w = NewSpeedscopeWriter(f, µsPerSample)
+				case "firefox":
+					w = NewFirefoxProfileWriter(f, µsPerSample)
+				default:
+					fmt.Fprintf(os.Stderr, "ERROR: unrecognized --format %q (expected one of spall, json, speedscope, firefox)\n", format)
+					os.Exit(1)
+				}
+
+				var stdin io.Reader = os.Stdin
+				if follow {
+					stdin = &followReader{r: stdin, interval: 100 * time.Millisecond}
+				}
+				if passthrough {
+					stdin = io.TeeReader(stdin, os.Stdout)
 				}
 
-				type PidTid struct {
-					Pid, Tid uint32
+				normalizer := NewStackNormalizer(demangleMode, keepOffsets, collapseTemplates)
+
+				var parser InputParser
+				switch input {
+				case "dtrace":
+					parser = NewDTraceParser(stdin, fields, timeSource, µsPerSample, normalizer)
+				case "perf":
+					parser = NewPerfScriptParser(stdin, µsPerSample, normalizer)
+				case "bpftrace":
+					parser = NewBpftraceParser(stdin, normalizer)
+				default:
+					fmt.Fprintf(os.Stderr, "ERROR: unrecognized --input %q (expected one of dtrace, perf, bpftrace)\n", input)
+					os.Exit(1)
 				}
+
+				// wMu guards all access to w, since it is written to from the
+				// main scanning loop as well as the periodic flush and the
+				// shutdown signal handler below.
+				var wMu sync.Mutex
+
 				type ThreadState struct {
 					LatestStack []string
 				}
 
-				state := StateExpectingNewFrame
-				var pid, tid uint32
-				var threadStates = make(map[PidTid]*ThreadState)
-				var stackEntries []string // the stack entries we've built up so far (reverse order because hooray dtrace)
 				var now float64 = 0
+				var threadStates = make(map[PidTid]*ThreadState)
 
-				addStackEntry := func(line string) {
-					line = reOffset.ReplaceAllString(line, "")
-					line = reCFunctionArgument.ReplaceAllString(line, "$1")
-					if line == "" {
-						line = "-"
+				// closeAllFrames ends every still-open Begin frame on every
+				// thread, so the trace is well-formed even if we're cut off
+				// mid-stack.
+				closeAllFrames := func() {
+					for ptk, threadState := range threadStates {
+						for range threadState.LatestStack {
+							w.End(ptk.Tid, ptk.Pid, now)
+						}
+						threadState.LatestStack = nil
 					}
-					stackEntries = append(stackEntries, line)
 				}
 
+				sigCh := make(chan os.Signal, 1)
+				signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+				go func() {
+					<-sigCh
+					wMu.Lock()
+					defer wMu.Unlock()
+					closeAllFrames()
+					w.Footer()
+					done()
+					os.Exit(0)
+				}()
+
+				if follow {
+					ticker := time.NewTicker(time.Duration(flushMs) * time.Millisecond)
+					defer ticker.Stop()
+					go func() {
+						for range ticker.C {
+							wMu.Lock()
+							w.Flush()
+							wMu.Unlock()
+						}
+					}()
+				}
+
+				wMu.Lock()
 				w.Header()
+				wMu.Unlock()
 
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					if passthrough {
-						fmt.Fprintln(os.Stdout, line)
+				for {
+					frame, err := parser.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "ERROR:", err)
+						os.Exit(1)
 					}
-					line = strings.TrimSpace(line)
 
-					if line == "" {
-						// Nothin'. Must be between frames.
-						state = StateExpectingNewFrame
-					} else if state == StateExpectingNewFrame {
-						// Non-empty line starts a new frame
+					wMu.Lock()
+					func() {
+						defer wMu.Unlock()
 
-						// Parse fields, or just start directly at the trace
-						if len(fields) == 0 {
-							addStackEntry(line)
+						if frame.Absolute {
+							now = frame.Weight
 						} else {
-							fieldStrs := reWhitespace.Split(line, -1)
-							if len(fieldStrs) != len(fields) {
-								fmt.Fprintf(os.Stderr, "ERROR: Expected %d fields but got %d. Problematic line:\n", len(fields), len(fieldStrs))
-								fmt.Fprintln(os.Stderr, line)
-								os.Exit(1)
-							}
-
-							for i, fieldStr := range fieldStrs {
-								switch fields[i] {
-								case "pid":
-									pidU64, err := strconv.ParseUint(fieldStr, 10, 32)
-									if err != nil {
-										fmt.Fprintf(os.Stderr, "ERROR: \"%s\" is not a valid pid.\n", fieldStr)
-										os.Exit(1)
-									}
-									pid = uint32(pidU64)
-								case "tid":
-									tidU64, err := strconv.ParseUint(fieldStr, 10, 32)
-									if err != nil {
-										fmt.Fprintf(os.Stderr, "ERROR: \"%s\" is not a valid tid.\n", fieldStr)
-										os.Exit(1)
-									}
-									tid = uint32(tidU64)
-								default:
-									// Ignore all others.
-								}
-							}
-						}
-
-						state = StateInFrame
-					} else if state == StateInFrame && reCount.MatchString(line) {
-						// End of a stack; track the stuff
-						count, err := strconv.Atoi(line)
-						if err != nil {
-							panic(fmt.Errorf("'%s' is not a valid sample count", line))
+							now += frame.Weight
 						}
-						now += float64(count)
 
-						threadState, ok := threadStates[PidTid{pid, tid}]
+						ptk := PidTid{Pid: frame.Pid, Tid: frame.Tid}
+						threadState, ok := threadStates[ptk]
 						if !ok {
 							threadState = &ThreadState{}
-							threadStates[PidTid{pid, tid}] = threadState
+							threadStates[ptk] = threadState
 						}
 
-						for i := 0; i < len(stackEntries); i++ {
-							entry := stackEntries[len(stackEntries)-1-i] // accessing in reverse
+						for i, entry := range frame.Stack {
 							if i < len(threadState.LatestStack) && threadState.LatestStack[i] != entry {
 								// Different entry - end everything past this point
 								for j := len(threadState.LatestStack) - 1; j >= i; j-- {
-									w.End(tid, pid, now)
+									w.End(frame.Tid, frame.Pid, now)
 								}
 								threadState.LatestStack = threadState.LatestStack[:i]
 							}
 							if i >= len(threadState.LatestStack) {
 								// New stack entries; begin these events
-								w.Begin(entry, uint32(tid), pid, now)
+								w.Begin(entry, frame.Tid, frame.Pid, now)
 								threadState.LatestStack = append(threadState.LatestStack, entry)
 							}
 						}
-
-						// Reset frame
-						pid, tid = 0, 0
-						stackEntries = stackEntries[:0] // reset stack in place (reuse memory)
-						state = StateExpectingNewFrame
-					} else if state == StateInFrame {
-						// One entry in a stack
-						addStackEntry(line)
-					} else {
-						panic("bad state!")
-					}
-				}
-				if err := scanner.Err(); err != nil {
-					fmt.Fprintln(os.Stderr, "reading standard input:", err)
+					}()
 				}
 
+				wMu.Lock()
 				w.Footer()
+				wMu.Unlock()
 			}
 		},
 	}
-	rootCmd.PersistentFlags().IntP("freq", "f", 1000, "The frequency of profile sampling, in Hz.")
+	rootCmd.PersistentFlags().IntP("freq", "f", 1000, "The frequency of profile sampling, in Hz. Only meaningful for --input=bpftrace, and for --input=dtrace with --time-source=count.")
 	rootCmd.PersistentFlags().StringP("out", "o", "-", "The file to write the results to. Use \"-\" for stdout.")
-	rootCmd.PersistentFlags().StringSlice("fields", nil, "An array of fields preceding each stack. Valid fields: pid, tid. Any unrecognized fields will be ignored (consider using \"-\" for any such fields).")
+	rootCmd.PersistentFlags().StringSlice("fields", nil, "An array of fields preceding each stack, for --input=dtrace. Valid fields: pid, tid, timestamp, walltimestamp. Any unrecognized fields will be ignored (consider using \"-\" for any such fields).")
 	rootCmd.PersistentFlags().Bool("passthrough", false, "Pass the input data through to stdout, making this tool invisible to pipelines. Requires --out.")
-	rootCmd.PersistentFlags().Bool("json", false, "Output chrome://tracing JSON instead of the Spall format.")
+	rootCmd.PersistentFlags().String("format", "spall", "Output format: spall, json (chrome://tracing), speedscope, or firefox.")
+	rootCmd.PersistentFlags().String("input", "dtrace", "Input format to parse: dtrace, perf (perf script output), or bpftrace (histogram output).")
+	rootCmd.PersistentFlags().BoolP("follow", "F", false, "Keep reading standard input past EOF, like tail -f, for live-streamed input. Closes any open frames and writes the footer on SIGINT/SIGTERM.")
+	rootCmd.PersistentFlags().Int("flush-interval", 500, "When using --follow, how often (in milliseconds) to flush the output so consumers can see events as they arrive. Only --format=json writes events as they arrive; for spall, speedscope and firefox the flush does nothing.")
+	rootCmd.PersistentFlags().String("time-source", "count", "For --input=dtrace, how to compute event timestamps: count (accumulate the sample count, assuming a fixed --freq), timestamp (use the \"timestamp\" field, in ns), or walltimestamp (use the \"walltimestamp\" field, in ns). The timestamp/walltimestamp field must be included in --fields.")
+	rootCmd.PersistentFlags().String("demangle", "none", "Demangle mangled symbol names before the rest of stack entry normalization: none, itanium (C++), rust, swift, or auto (try each). Swift demangling is currently a no-op pass-through.")
+	rootCmd.PersistentFlags().Bool("keep-offsets", false, "Keep the \"+offset\" suffix on stack frame symbols instead of stripping it.")
+	rootCmd.PersistentFlags().Bool("collapse-templates", true, "Collapse C++ function arguments and template parameter lists in stack frame symbols. Set to false to keep them as-is.")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
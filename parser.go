@@ -0,0 +1,39 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/bvisness/spall-go"
+)
+
+var reWhitespace = regexp.MustCompile(`\s+`)
+var reCount = regexp.MustCompile(`^\d+$`)
+var reOffset = regexp.MustCompile(`\+[^+]*$`)
+var reCFunctionArgument = regexp.MustCompile(`(::.*)[(<].*`)
+
+// Frame is one sample observed by an InputParser: a call stack on a single
+// thread, in root-to-leaf order, plus a weight used to advance the running
+// "now" clock that drives ProfileWriter.Begin/End.
+type Frame struct {
+	Pid, Tid uint32
+	Stack    []string // root-to-leaf
+
+	// Weight advances "now". If Absolute is true, Weight replaces "now"
+	// outright (e.g. a real timestamp); otherwise it is added to "now"
+	// (e.g. a sample count at a fixed --freq).
+	Weight   float64
+	Absolute bool
+}
+
+// InputParser turns some sampling profiler's text output into a stream of
+// Frames. Next returns io.EOF once the input is exhausted.
+type InputParser interface {
+	Next() (Frame, error)
+}
+
+// nsToWhen converts a nanosecond timestamp to the "when" unit that
+// ProfileWriter.Begin/End expect, i.e. the inverse of the *unit
+// multiplication writers use to recover microseconds (see JSONWriter.Begin).
+func nsToWhen(ns uint64, unit spall.TimestampUnit) float64 {
+	return float64(ns) / 1000 / float64(unit)
+}
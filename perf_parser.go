@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bvisness/spall-go"
+)
+
+var rePerfHeader = regexp.MustCompile(`^(\S+)\s+(\d+)/(\d+)\s+\[\d+\]\s+([\d.]+):\s*(?:\d+\s+)?\S+:?\s*$`)
+var rePerfStackLine = regexp.MustCompile(`^\s*[0-9a-fA-Fx]+\s+(.+?)\s+\([^)]*\)\s*$`)
+
+// PerfScriptParser parses the standard `perf script` output: a header line
+// per sample ("comm pid/tid [cpu] ts: event:") followed by indented
+// "addr symbol+offset (dso)" stack lines, terminated by a blank line (or
+// EOF). perf's own timestamps are used as the authoritative clock.
+type PerfScriptParser struct {
+	scanner    *bufio.Scanner
+	unit       spall.TimestampUnit
+	normalizer *StackNormalizer
+
+	inSample bool
+	pid, tid uint32
+	ts       float64  // seconds, as printed by perf script
+	stack    []string // leaf-to-root, as perf prints them
+}
+
+func NewPerfScriptParser(r io.Reader, unit spall.TimestampUnit, normalizer *StackNormalizer) *PerfScriptParser {
+	return &PerfScriptParser{scanner: bufio.NewScanner(r), unit: unit, normalizer: normalizer}
+}
+
+func (p *PerfScriptParser) Next() (Frame, error) {
+	for p.scanner.Scan() {
+		line := p.scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			if p.inSample && len(p.stack) > 0 {
+				return p.emit(), nil
+			}
+			p.inSample = false
+			continue
+		}
+
+		if m := rePerfHeader.FindStringSubmatch(line); m != nil {
+			pid, err := strconv.ParseUint(m[2], 10, 32)
+			if err != nil {
+				return Frame{}, fmt.Errorf("%q is not a valid pid", m[2])
+			}
+			tid, err := strconv.ParseUint(m[3], 10, 32)
+			if err != nil {
+				return Frame{}, fmt.Errorf("%q is not a valid tid", m[3])
+			}
+			ts, err := strconv.ParseFloat(m[4], 64)
+			if err != nil {
+				return Frame{}, fmt.Errorf("%q is not a valid timestamp", m[4])
+			}
+			p.inSample = true
+			p.pid, p.tid, p.ts = uint32(pid), uint32(tid), ts
+			p.stack = p.stack[:0]
+			continue
+		}
+
+		if m := rePerfStackLine.FindStringSubmatch(line); m != nil && p.inSample {
+			p.stack = append(p.stack, p.normalizer.Normalize(m[1]))
+			continue
+		}
+
+		// Ignore anything else, e.g. comment lines perf script sometimes emits.
+	}
+	if err := p.scanner.Err(); err != nil {
+		return Frame{}, err
+	}
+	if p.inSample && len(p.stack) > 0 {
+		return p.emit(), nil
+	}
+	return Frame{}, io.EOF
+}
+
+func (p *PerfScriptParser) emit() Frame {
+	stack := make([]string, len(p.stack))
+	for i, entry := range p.stack {
+		stack[len(p.stack)-1-i] = entry // perf prints leaf-to-root; Frame wants root-to-leaf
+	}
+
+	p.inSample = false
+	p.stack = nil
+
+	return Frame{
+		Pid:      p.pid,
+		Tid:      p.tid,
+		Stack:    stack,
+		Weight:   nsToWhen(uint64(p.ts*1e9), p.unit),
+		Absolute: true,
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPerfScriptParserHappyPath(t *testing.T) {
+	input := "comm 123/456 [001] 1000.500000: cycles:\n" +
+		"\t    400000 foo+0x10 (/bin/a.out)\n" +
+		"\t    400010 bar+0x20 (/bin/a.out)\n" +
+		"\n"
+	p := NewPerfScriptParser(strings.NewReader(input), 1000, NewStackNormalizer("none", false, true))
+
+	frame, err := p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame.Pid != 123 || frame.Tid != 456 {
+		t.Fatalf("unexpected pid/tid: %+v", frame)
+	}
+	if !frame.Absolute {
+		t.Fatalf("expected Absolute=true, perf timestamps are authoritative")
+	}
+	if want := []string{"bar", "foo"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+// TestPerfScriptParserEOFWithoutTrailingBlankLine covers the case where perf
+// script's last sample isn't followed by a blank line before EOF.
+func TestPerfScriptParserEOFWithoutTrailingBlankLine(t *testing.T) {
+	input := "comm 123/456 [001] 1000.500000: cycles:\n" +
+		"\t    400000 foo+0x10 (/bin/a.out)\n"
+	p := NewPerfScriptParser(strings.NewReader(input), 1000, NewStackNormalizer("none", false, true))
+
+	frame, err := p.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"foo"}; !reflect.DeepEqual(frame.Stack, want) {
+		t.Fatalf("unexpected stack: got %v want %v", frame.Stack, want)
+	}
+
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
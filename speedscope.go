@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/bvisness/spall-go"
+)
+
+// SpeedscopeWriter buffers the whole profile in memory and emits it as
+// speedscope's "evented" JSON format in Footer, since that format needs a
+// shared frame table and a list of per-thread profiles up front rather than
+// a stream of independent events.
+//
+// https://github.com/jlfwong/speedscope/wiki/Importing-from-custom-sources
+type SpeedscopeWriter struct {
+	w    io.Writer
+	unit spall.TimestampUnit
+
+	frameIndices map[string]int
+	frameNames   []string
+
+	order  []PidTid
+	stacks map[PidTid][]int
+	events map[PidTid][]speedscopeEvent
+}
+
+type speedscopeEvent struct {
+	Type  string `json:"type"`
+	Frame int    `json:"frame"`
+	At    int64  `json:"at"`
+}
+
+func NewSpeedscopeWriter(w io.Writer, unit spall.TimestampUnit) ProfileWriter {
+	return &SpeedscopeWriter{
+		w:            w,
+		unit:         unit,
+		frameIndices: make(map[string]int),
+		stacks:       make(map[PidTid][]int),
+		events:       make(map[PidTid][]speedscopeEvent),
+	}
+}
+
+func (w *SpeedscopeWriter) Header() {}
+func (w *SpeedscopeWriter) Flush()  {}
+
+func (w *SpeedscopeWriter) frame(name string) int {
+	if i, ok := w.frameIndices[name]; ok {
+		return i
+	}
+	i := len(w.frameNames)
+	w.frameIndices[name] = i
+	w.frameNames = append(w.frameNames, name)
+	return i
+}
+
+func (w *SpeedscopeWriter) addEvent(ptk PidTid, ev speedscopeEvent) {
+	if _, ok := w.events[ptk]; !ok {
+		w.order = append(w.order, ptk)
+	}
+	w.events[ptk] = append(w.events[ptk], ev)
+}
+
+func (w *SpeedscopeWriter) Begin(name string, tid, pid uint32, when float64) {
+	ptk := PidTid{Pid: pid, Tid: tid}
+	frame := w.frame(name)
+	w.stacks[ptk] = append(w.stacks[ptk], frame)
+	w.addEvent(ptk, speedscopeEvent{
+		Type:  "O",
+		Frame: frame,
+		At:    int64(when * float64(w.unit)),
+	})
+}
+
+func (w *SpeedscopeWriter) End(tid, pid uint32, when float64) {
+	ptk := PidTid{Pid: pid, Tid: tid}
+	stack := w.stacks[ptk]
+	if len(stack) == 0 {
+		return
+	}
+	frame := stack[len(stack)-1]
+	w.stacks[ptk] = stack[:len(stack)-1]
+	w.addEvent(ptk, speedscopeEvent{
+		Type:  "C",
+		Frame: frame,
+		At:    int64(when * float64(w.unit)),
+	})
+}
+
+func (w *SpeedscopeWriter) Footer() {
+	type sharedFrame struct {
+		Name string `json:"name"`
+	}
+	type profile struct {
+		Type       string            `json:"type"`
+		Name       string            `json:"name"`
+		Unit       string            `json:"unit"`
+		StartValue int64             `json:"startValue"`
+		EndValue   int64             `json:"endValue"`
+		Events     []speedscopeEvent `json:"events"`
+	}
+	type file struct {
+		Schema string `json:"$schema"`
+		Shared struct {
+			Frames []sharedFrame `json:"frames"`
+		} `json:"shared"`
+		Profiles []profile `json:"profiles"`
+	}
+
+	// Events carry whatever absolute "when" the writer was given (e.g. real
+	// ns-scale timestamps from --time-source=timestamp/walltimestamp, or
+	// perf's epoch-scale clock), so rebase everything to the earliest event
+	// across all threads rather than emitting a hardcoded StartValue: 0 that
+	// would bury the actual activity in a multi-decade timeline.
+	var min int64
+	haveMin := false
+	for _, ptk := range w.order {
+		for _, ev := range w.events[ptk] {
+			if !haveMin || ev.At < min {
+				min, haveMin = ev.At, true
+			}
+		}
+	}
+
+	out := file{Schema: "https://www.speedscope.app/file-format-schema.json"}
+	for _, name := range w.frameNames {
+		out.Shared.Frames = append(out.Shared.Frames, sharedFrame{Name: name})
+	}
+	for _, ptk := range w.order {
+		events := make([]speedscopeEvent, len(w.events[ptk]))
+		for i, ev := range w.events[ptk] {
+			ev.At -= min
+			events[i] = ev
+		}
+		var start, end int64
+		if n := len(events); n > 0 {
+			start, end = events[0].At, events[n-1].At
+		}
+		out.Profiles = append(out.Profiles, profile{
+			Type:       "evented",
+			Name:       fmt.Sprintf("pid %d tid %d", ptk.Pid, ptk.Tid),
+			Unit:       "microseconds",
+			StartValue: start,
+			EndValue:   end,
+			Events:     events,
+		})
+	}
+
+	data, _ := json.Marshal(out)
+	w.w.Write(data)
+}
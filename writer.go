@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/bvisness/spall-go"
+)
+
+// PidTid identifies a single thread within a single process, and is used to
+// key per-thread state across the scanner and the various ProfileWriters.
+type PidTid struct {
+	Pid, Tid uint32
+}
+
+type ProfileWriter interface {
+	Header()
+	Begin(name string, tid, pid uint32, when float64)
+	End(tid, pid uint32, when float64)
+	Flush()
+	Footer()
+}
+
+type SpallWriter struct {
+	spall.Eventer
+}
+
+func NewSpallWriter(w io.Writer, unit spall.TimestampUnit) (ProfileWriter, func()) {
+	p := spall.NewProfile(w, unit)
+	e := p.NewEventer()
+
+	return &SpallWriter{e}, func() {
+		e.Close()
+		p.Close()
+	}
+}
+
+func (w *SpallWriter) Header() {}
+func (w *SpallWriter) Footer() {}
+
+func (w *SpallWriter) Begin(name string, tid, pid uint32, when float64) {
+	w.Eventer.BeginTidPid(name, tid, pid, when)
+}
+
+func (w *SpallWriter) End(tid, pid uint32, when float64) {
+	w.Eventer.EndTidPid(tid, pid, when)
+}
+
+// Flush is a no-op for the spall format: spall.Eventer buffers events on the
+// C side and only flushes them to the underlying io.Writer when closed (see
+// done() in NewSpallWriter), so there is no way to force an incremental
+// flush without tearing down the eventer. Periodic --flush-interval ticks
+// have no visible effect on --format=spall. Of the output formats, only json
+// writes events as they arrive; speedscope and firefox write everything in
+// Footer.
+func (w *SpallWriter) Flush() {}
+
+type JSONWriter struct {
+	w        io.Writer
+	unit     spall.TimestampUnit
+	didEvent bool
+}
+
+func NewJSONWriter(w io.Writer, unit spall.TimestampUnit) ProfileWriter {
+	return &JSONWriter{
+		w:    w,
+		unit: unit,
+	}
+}
+
+func (w *JSONWriter) Header() {
+	w.w.Write([]byte("[\n"))
+}
+
+func (w *JSONWriter) Begin(name string, tid, pid uint32, when float64) {
+	type BeginEvent struct {
+		Name      string `json:"name"`
+		Cat       string `json:"cat"`
+		Type      string `json:"ph"`
+		Timestamp int64  `json:"ts"`
+		Pid       uint32 `json:"pid"`
+		Tid       uint32 `json:"tid"`
+	}
+
+	if w.didEvent {
+		w.w.Write([]byte(",\n"))
+	}
+	event, _ := json.Marshal(BeginEvent{
+		Name:      name,
+		Cat:       "dtrace",
+		Type:      "B",
+		Timestamp: int64(when * float64(w.unit)),
+		Pid:       pid,
+		Tid:       tid,
+	})
+	w.w.Write(event)
+
+	w.didEvent = true
+}
+
+func (w *JSONWriter) End(tid, pid uint32, when float64) {
+	type EndEvent struct {
+		Type      string `json:"ph"`
+		Timestamp int64  `json:"ts"`
+		Pid       uint32 `json:"pid"`
+		Tid       uint32 `json:"tid"`
+	}
+
+	if w.didEvent {
+		w.w.Write([]byte(",\n"))
+	}
+	event, _ := json.Marshal(EndEvent{
+		Type:      "E",
+		Timestamp: int64(when * float64(w.unit)),
+		Pid:       pid,
+		Tid:       tid,
+	})
+	w.w.Write(event)
+
+	w.didEvent = true
+}
+
+func (w *JSONWriter) Flush() {
+	if f, ok := w.w.(*os.File); ok {
+		f.Sync()
+	}
+}
+
+func (w *JSONWriter) Footer() {
+	w.w.Write([]byte("\n]\n"))
+}